@@ -0,0 +1,245 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2024 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package highlight
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gohugoio/hugo/markup/converter/hooks"
+)
+
+// Config.AutoDetect enables language detection for fenced code blocks with no
+// (or an unrecognized) language on the fence, and Config.AutoDetectMinConfidence
+// is the minimum confidence (0-1) a guess needs before it's trusted over
+// falling through to Chroma's own guesser. Both default to off/conservative
+// in DefaultConfig, matching Hugo's existing opt-in stance on Tree-sitter
+// itself.
+
+// languageGuess is one candidate produced by the auto-detect pipeline.
+type languageGuess struct {
+	lang       string
+	confidence float64
+}
+
+// extensionLanguages maps common file extensions, as given via a fenced code
+// block's `file` attribute (```go {file="main.go"}`), to a treeSitterLanguages
+// key.
+var extensionLanguages = map[string]string{
+	".sh":        "bash",
+	".bash":      "bash",
+	".c":         "c",
+	".h":         "c",
+	".cpp":       "cpp",
+	".cc":        "cpp",
+	".hpp":       "cpp",
+	".cs":        "csharp",
+	".css":       "css",
+	".cue":       "cue",
+	"Dockerfile": "dockerfile",
+	".ex":        "elixir",
+	".exs":       "elixir",
+	".elm":       "elm",
+	".go":        "go",
+	".groovy":    "groovy",
+	".tf":        "hcl",
+	".hcl":       "hcl",
+	".html":      "html",
+	".htm":       "html",
+	".java":      "java",
+	".js":        "javascript",
+	".mjs":       "javascript",
+	".jsx":       "javascript",
+	".kt":        "kotlin",
+	".lua":       "lua",
+	".ml":        "ocaml",
+	".php":       "php",
+	".proto":     "protobuf",
+	".py":        "python",
+	".rb":        "ruby",
+	".rs":        "rust",
+	".scala":     "scala",
+	".sql":       "sql",
+	".svelte":    "svelte",
+	".swift":     "swift",
+	".toml":      "toml",
+	".yaml":      "yaml",
+	".yml":       "yaml",
+}
+
+// shebangInterpreters maps the interpreter named on a "#!" line to a
+// treeSitterLanguages key.
+var shebangInterpreters = map[string]string{
+	"sh":      "bash",
+	"bash":    "bash",
+	"python":  "python",
+	"python3": "python",
+	"ruby":    "ruby",
+	"node":    "javascript",
+}
+
+var (
+	shebangRE = regexp.MustCompile(`^#!\s*\S*/(?:env\s+)?(\w+)`)
+	phpTagRE  = regexp.MustCompile(`<\?php`)
+	doctypeRE = regexp.MustCompile(`(?i)<!DOCTYPE\s+html`)
+	goPkgRE   = regexp.MustCompile(`(?m)^package\s+\w+\s*$`)
+)
+
+// keywordSets holds, per language, a handful of tokens that are distinctive
+// enough to be a useful signal in a frequency-based guess. This is
+// intentionally small: it only needs to break ties between a handful of
+// commonly-untagged languages, not replace a real classifier like enry.
+var keywordSets = map[string][]string{
+	"go":         {"package", "func", "import", ":=", "interface{}", "chan "},
+	"python":     {"def ", "import ", "self", "elif", "__init__", "None"},
+	"javascript": {"function", "const ", "let ", "=>", "console.log", "require("},
+	"rust":       {"fn ", "let mut", "impl ", "::", "match ", "println!"},
+	"ruby":       {"def ", "end", "puts ", "require ", "@", "do |"},
+	"java":       {"public class", "public static void", "System.out", "import java"},
+	"c":          {"#include", "int main", "printf(", "malloc("},
+	"cpp":        {"#include", "std::", "cout <<", "namespace "},
+	"php":        {"<?php", "$", "function ", "echo "},
+	"css":        {"{", "}", ":", ";", "px", "#"},
+	"yaml":       {": ", "- ", "---"},
+}
+
+// detectLanguageFromShebangOrModeline looks for a "#!" interpreter line at
+// the start of code (after leading blank space), or else for a well-known
+// file-header pattern anywhere in it (PHP's "<?php", HTML's doctype, a Go
+// "package" clause on a line of its own).
+func detectLanguageFromShebangOrModeline(code string) (languageGuess, bool) {
+	trimmed := strings.TrimLeft(code, " \t\r\n")
+
+	if m := shebangRE.FindStringSubmatch(trimmed); m != nil {
+		if lang, ok := shebangInterpreters[m[1]]; ok {
+			return languageGuess{lang: lang, confidence: 0.95}, true
+		}
+	}
+
+	switch {
+	case phpTagRE.MatchString(trimmed):
+		return languageGuess{lang: "php", confidence: 0.9}, true
+	case doctypeRE.MatchString(trimmed):
+		return languageGuess{lang: "html", confidence: 0.9}, true
+	case goPkgRE.MatchString(trimmed):
+		return languageGuess{lang: "go", confidence: 0.75}, true
+	}
+
+	return languageGuess{}, false
+}
+
+// detectLanguageFromFilename maps a code fence's `file` attribute to a
+// language via its extension (or, for extension-less names like
+// "Dockerfile", the full base name).
+func detectLanguageFromFilename(filename string) (languageGuess, bool) {
+	if filename == "" {
+		return languageGuess{}, false
+	}
+
+	if lang, ok := extensionLanguages[filepath.Base(filename)]; ok {
+		return languageGuess{lang: lang, confidence: 0.9}, true
+	}
+
+	ext := filepath.Ext(filename)
+	if lang, ok := extensionLanguages[ext]; ok {
+		return languageGuess{lang: lang, confidence: 0.9}, true
+	}
+
+	return languageGuess{}, false
+}
+
+// detectLanguageFromKeywords scores code against keywordSets and returns the
+// best-matching language, with confidence being the fraction of that
+// language's keywords found in the code.
+func detectLanguageFromKeywords(code string) (languageGuess, bool) {
+	best := languageGuess{}
+	for lang, keywords := range keywordSets {
+		hits := 0
+		for _, kw := range keywords {
+			if strings.Contains(code, kw) {
+				hits++
+			}
+		}
+		if hits == 0 {
+			continue
+		}
+		confidence := float64(hits) / float64(len(keywords))
+		if confidence > best.confidence {
+			best = languageGuess{lang: lang, confidence: confidence}
+		}
+	}
+
+	if best.lang == "" {
+		return languageGuess{}, false
+	}
+	return best, true
+}
+
+// detectCodeLanguage runs the full auto-detect pipeline over code (and an
+// optional filename hint, from a code fence's `file` attribute) and returns
+// the highest-confidence guess, or a zero-value languageGuess if nothing
+// recognized anything.
+func detectCodeLanguage(code, filename string) languageGuess {
+	var guesses []languageGuess
+
+	if g, ok := detectLanguageFromShebangOrModeline(code); ok {
+		guesses = append(guesses, g)
+	}
+	if g, ok := detectLanguageFromFilename(filename); ok {
+		guesses = append(guesses, g)
+	}
+	if g, ok := detectLanguageFromKeywords(code); ok {
+		guesses = append(guesses, g)
+	}
+
+	if len(guesses) == 0 {
+		return languageGuess{}
+	}
+
+	sort.Slice(guesses, func(i, j int) bool { return guesses[i].confidence > guesses[j].confidence })
+	return guesses[0]
+}
+
+// resolveCodeBlockLanguage returns the language to highlight ctx with: its
+// declared fence language if that is a treeSitterLanguages key, otherwise
+// (no fence language, or one not in treeSitterLanguages) an auto-detected
+// guess when cfg.AutoDetect is on and that guess clears
+// cfg.AutoDetectMinConfidence. Without such a guess the declared fence
+// language, if any, is returned unchanged. detected reports whether the
+// returned language came from auto-detection, so callers can expose it back
+// to the template.
+func resolveCodeBlockLanguage(cfg Config, ctx hooks.CodeblockContext) (lang string, detected bool) {
+	t := ctx.Type()
+	if t != "" {
+		if _, known := treeSitterLanguages[strings.ToLower(t)]; known || !cfg.AutoDetect {
+			return t, false
+		}
+	}
+	if !cfg.AutoDetect {
+		return "", false
+	}
+
+	filename, _ := ctx.Attributes()["file"].(string)
+	guess := detectCodeLanguage(ctx.Inner(), filename)
+	if guess.lang == "" || guess.confidence < cfg.AutoDetectMinConfidence {
+		return t, false
+	}
+
+	return guess.lang, true
+}
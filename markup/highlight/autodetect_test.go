@@ -0,0 +1,114 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2024 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package highlight
+
+import (
+	"testing"
+
+	"github.com/frankban/quicktest"
+)
+
+func TestDetectLanguageFromShebangOrModeline(t *testing.T) {
+	c := quicktest.New(t)
+
+	testCases := []struct {
+		name string
+		code string
+		lang string
+	}{
+		{"python shebang", "#!/usr/bin/env python\nprint('hi')", "python"},
+		{"bash shebang", "#!/bin/bash\necho hi", "bash"},
+		{"php tag", "<?php\necho 'hi';", "php"},
+		{"html doctype", "<!DOCTYPE html>\n<html></html>", "html"},
+		{"go package clause", "package main\n\nfunc main() {}", "go"},
+	}
+
+	for _, tc := range testCases {
+		c.Run(tc.name, func(c *quicktest.C) {
+			guess, ok := detectLanguageFromShebangOrModeline(tc.code)
+			c.Assert(ok, quicktest.Equals, true)
+			c.Assert(guess.lang, quicktest.Equals, tc.lang)
+		})
+	}
+}
+
+func TestDetectLanguageFromFilename(t *testing.T) {
+	c := quicktest.New(t)
+
+	testCases := []struct {
+		filename string
+		lang     string
+	}{
+		{"main.go", "go"},
+		{"app.py", "python"},
+		{"index.js", "javascript"},
+		{"Dockerfile", "dockerfile"},
+		{"unknown.xyz", ""},
+	}
+
+	for _, tc := range testCases {
+		c.Run(tc.filename, func(c *quicktest.C) {
+			guess, ok := detectLanguageFromFilename(tc.filename)
+			if tc.lang == "" {
+				c.Assert(ok, quicktest.Equals, false)
+				return
+			}
+			c.Assert(ok, quicktest.Equals, true)
+			c.Assert(guess.lang, quicktest.Equals, tc.lang)
+		})
+	}
+}
+
+func TestDetectCodeLanguagePrefersHigherConfidence(t *testing.T) {
+	c := quicktest.New(t)
+
+	// A Go shebang-less, filename-less snippet should still be recognized
+	// from its package clause plus keyword frequency.
+	guess := detectCodeLanguage("package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hi\")\n}", "")
+	c.Assert(guess.lang, quicktest.Equals, "go")
+}
+
+func TestResolveCodeBlockLanguage(t *testing.T) {
+	c := quicktest.New(t)
+
+	cfg := DefaultConfig
+	cfg.AutoDetect = true
+	cfg.AutoDetectMinConfidence = 0.5
+
+	ctx := &mockCodeblockContext{
+		inner: "#!/usr/bin/env python\nprint('hi')",
+		typ:   "",
+	}
+
+	lang, detected := resolveCodeBlockLanguage(cfg, ctx)
+	c.Assert(detected, quicktest.Equals, true)
+	c.Assert(lang, quicktest.Equals, "python")
+
+	// A declared fence language that Tree-sitter knows always wins over
+	// detection.
+	ctx.typ = "ruby"
+	lang, detected = resolveCodeBlockLanguage(cfg, ctx)
+	c.Assert(detected, quicktest.Equals, false)
+	c.Assert(lang, quicktest.Equals, "ruby")
+
+	// Auto-detect off: no guess even with a strong signal.
+	cfg.AutoDetect = false
+	ctx.typ = ""
+	lang, detected = resolveCodeBlockLanguage(cfg, ctx)
+	c.Assert(detected, quicktest.Equals, false)
+	c.Assert(lang, quicktest.Equals, "")
+}
@@ -0,0 +1,144 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2024 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package highlight
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// defaultCacheSize is used in place of Config.CacheSize when it is left at
+// its zero value, i.e. when the site config doesn't opt into a specific
+// size.
+const defaultCacheSize = 4096
+
+// parserPools holds one *sync.Pool of *sitter.Parser per query directory, so
+// repeated highlighting of the same language reuses parsers instead of
+// paying sitter.NewParser's setup cost every call. Pools are created lazily
+// and never removed, mirroring highlightQueryCache and friends.
+var parserPools sync.Map // map[string]*sync.Pool
+
+// acquireParser returns a *sitter.Parser already configured for entry's
+// grammar, either freshly created or recycled from entry's pool. The caller
+// must return it via releaseParser once done.
+func acquireParser(entry treeSitterLanguage) *sitter.Parser {
+	pool, _ := parserPools.LoadOrStore(entry.queryDir, &sync.Pool{
+		New: func() any {
+			parser := sitter.NewParser()
+			parser.SetLanguage(entry.grammar())
+			return parser
+		},
+	})
+	return pool.(*sync.Pool).Get().(*sitter.Parser)
+}
+
+// releaseParser returns parser to entry's pool for reuse.
+func releaseParser(entry treeSitterLanguage, parser *sitter.Parser) {
+	pool, ok := parserPools.Load(entry.queryDir)
+	if !ok {
+		return
+	}
+	pool.(*sync.Pool).Put(parser)
+}
+
+// htmlCache is a fixed-size, concurrency-safe LRU cache from a content hash
+// to already-rendered highlighted HTML, letting repeated requests for the
+// same code block (a common case when rebuilding a site) skip parsing and
+// query execution entirely.
+type htmlCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[uint64]*list.Element
+}
+
+type htmlCacheEntry struct {
+	key  uint64
+	html string
+}
+
+// newHTMLCache creates an htmlCache holding at most capacity entries,
+// evicting the least recently used one once full. A non-positive capacity
+// disables caching: get always misses and add is a no-op. A nil *htmlCache
+// behaves the same way.
+func newHTMLCache(capacity int) *htmlCache {
+	return &htmlCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[uint64]*list.Element),
+	}
+}
+
+func (c *htmlCache) get(key uint64) (string, bool) {
+	if c == nil || c.capacity <= 0 {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*htmlCacheEntry).html, true
+}
+
+func (c *htmlCache) add(key uint64, html string) {
+	if c == nil || c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*htmlCacheEntry).html = html
+		return
+	}
+
+	el := c.ll.PushFront(&htmlCacheEntry{key: key, html: html})
+	c.items[key] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*htmlCacheEntry).key)
+		}
+	}
+}
+
+// cacheKey hashes everything that can affect rendered output for a given
+// piece of code: the resolved query directory (so language aliases like
+// "js"/"javascript" share a cache entry), the source itself, and a
+// fingerprint of the config options that feed into rendering.
+func cacheKey(queryDir, code string, cfg Config) uint64 {
+	d := xxhash.New()
+	d.Write([]byte(queryDir))
+	d.Write([]byte{0})
+	d.Write([]byte(code))
+	d.Write([]byte{0})
+	fmt.Fprintf(d, "%t|%t|%f|%s|%t|%s", cfg.NoClasses, cfg.AutoDetect, cfg.AutoDetectMinConfidence, cfg.Style, cfg.Hl_inline, cfg.WrapperClass)
+	return d.Sum64()
+}
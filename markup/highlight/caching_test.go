@@ -0,0 +1,98 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2024 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package highlight
+
+import (
+	"testing"
+
+	"github.com/frankban/quicktest"
+)
+
+func TestHTMLCache(t *testing.T) {
+	c := quicktest.New(t)
+
+	cache := newHTMLCache(2)
+
+	_, ok := cache.get(1)
+	c.Assert(ok, quicktest.IsFalse)
+
+	cache.add(1, "one")
+	cache.add(2, "two")
+
+	html, ok := cache.get(1)
+	c.Assert(ok, quicktest.IsTrue)
+	c.Assert(html, quicktest.Equals, "one")
+
+	// Adding a third entry evicts the least recently used one. Key 1 was
+	// just read above, so key 2 should be the one evicted.
+	cache.add(3, "three")
+
+	_, ok = cache.get(2)
+	c.Assert(ok, quicktest.IsFalse)
+
+	html, ok = cache.get(1)
+	c.Assert(ok, quicktest.IsTrue)
+	c.Assert(html, quicktest.Equals, "one")
+
+	html, ok = cache.get(3)
+	c.Assert(ok, quicktest.IsTrue)
+	c.Assert(html, quicktest.Equals, "three")
+}
+
+func TestHTMLCacheDisabled(t *testing.T) {
+	c := quicktest.New(t)
+
+	cache := newHTMLCache(0)
+	cache.add(1, "one")
+
+	_, ok := cache.get(1)
+	c.Assert(ok, quicktest.IsFalse)
+}
+
+func TestCacheKeyStableAndSensitive(t *testing.T) {
+	c := quicktest.New(t)
+
+	cfg := DefaultConfig
+	a := cacheKey("go", "package main", cfg)
+	b := cacheKey("go", "package main", cfg)
+	c.Assert(a, quicktest.Equals, b)
+
+	diffCode := cacheKey("go", "package other", cfg)
+	c.Assert(diffCode, quicktest.Not(quicktest.Equals), a)
+
+	diffLang := cacheKey("python", "package main", cfg)
+	c.Assert(diffLang, quicktest.Not(quicktest.Equals), a)
+
+	diffCfg := cfg
+	diffCfg.NoClasses = !cfg.NoClasses
+	c.Assert(cacheKey("go", "package main", diffCfg), quicktest.Not(quicktest.Equals), a)
+}
+
+func TestAcquireReleaseParser(t *testing.T) {
+	c := quicktest.New(t)
+
+	entry := treeSitterLanguages["go"]
+
+	parser := acquireParser(entry)
+	c.Assert(parser, quicktest.IsNotNil)
+	releaseParser(entry, parser)
+
+	// The released parser should be handed back out by a subsequent
+	// acquire rather than a new one being allocated every time.
+	reused := acquireParser(entry)
+	c.Assert(reused, quicktest.Equals, parser)
+}
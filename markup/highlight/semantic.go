@@ -0,0 +1,218 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2024 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package highlight
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// localsQueryCache holds compiled locals.scm queries keyed by query
+// directory, mirroring highlightQueryCache.
+var localsQueryCache sync.Map // map[string]*sitter.Query
+
+// loadLocalsQuery returns the compiled locals.scm query for the given query
+// directory, compiling and caching it on first use. It returns an error if
+// the language has no locals.scm, which simply means it has no semantic
+// (beyond-lexical) highlighting yet.
+func loadLocalsQuery(queryDir string, lang *sitter.Language) (*sitter.Query, error) {
+	if cached, ok := localsQueryCache.Load(queryDir); ok {
+		return cached.(*sitter.Query), nil
+	}
+
+	data, err := queriesFS.ReadFile(path.Join("queries", queryDir, "locals.scm"))
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := sitter.NewQuery(data, lang)
+	if err != nil {
+		return nil, fmt.Errorf("highlight: compiling locals.scm for %q: %w", queryDir, err)
+	}
+
+	actual, _ := localsQueryCache.LoadOrStore(queryDir, query)
+	return actual.(*sitter.Query), nil
+}
+
+// scopeRange is a lexical scope's byte range, as established by a
+// @local.scope capture (or, for the implicit file-level scope, the whole
+// source).
+type scopeRange struct {
+	start, end uint32
+}
+
+// localDefinition is one @local.definition.<kind> capture: a variable,
+// parameter, function or type being introduced.
+type localDefinition struct {
+	name       string
+	kind       string
+	start, end uint32
+	used       bool
+}
+
+// localReference is one @local.reference capture: an identifier used in a
+// context (call, operand, return value, ...) rather than being defined.
+type localReference struct {
+	name       string
+	start, end uint32
+}
+
+// collectSemanticSpans runs entry's locals.scm (if any) over root, resolves
+// each reference to its nearest enclosing definition, and returns a
+// highlightSpan per definition and resolved reference carrying a class more
+// specific than plain lexical highlighting can give (a function definition
+// vs. a call, a parameter, an unreferenced local, ...). These spans share
+// the same byte-range-keyed dedupe as highlights.scm spans, so a semantic
+// span for a node wins over a lexical one for the same range when its
+// capture name has more dotted parts; when both have the same number of
+// parts, which of the two is kept is not defined.
+func (h *treeSitterHighlighter) collectSemanticSpans(entry treeSitterLanguage, root *sitter.Node, source []byte) []highlightSpan {
+	query, err := loadLocalsQuery(entry.queryDir, entry.grammar())
+	if err != nil {
+		return nil
+	}
+
+	qc := sitter.NewQueryCursor()
+	defer qc.Close()
+	qc.Exec(query, root)
+
+	scopes := []scopeRange{{start: 0, end: uint32(len(source))}}
+	var defs []*localDefinition
+	var refs []localReference
+
+	for {
+		match, ok := qc.NextMatch()
+		if !ok {
+			break
+		}
+		for _, capture := range match.Captures {
+			name := query.CaptureNameForId(capture.Index)
+			switch {
+			case name == "local.scope":
+				scopes = append(scopes, scopeRange{start: capture.Node.StartByte(), end: capture.Node.EndByte()})
+			case strings.HasPrefix(name, "local.definition."):
+				defs = append(defs, &localDefinition{
+					name:  capture.Node.Content(source),
+					kind:  strings.TrimPrefix(name, "local.definition."),
+					start: capture.Node.StartByte(),
+					end:   capture.Node.EndByte(),
+				})
+			case name == "local.reference":
+				refs = append(refs, localReference{
+					name:  capture.Node.Content(source),
+					start: capture.Node.StartByte(),
+					end:   capture.Node.EndByte(),
+				})
+			}
+		}
+	}
+
+	return resolveLocals(scopes, defs, refs)
+}
+
+// enclosingScopes returns the scopes containing [start, end), innermost
+// (narrowest) first.
+func enclosingScopes(scopes []scopeRange, start, end uint32) []scopeRange {
+	var enclosing []scopeRange
+	for _, s := range scopes {
+		if s.start <= start && end <= s.end {
+			enclosing = append(enclosing, s)
+		}
+	}
+	sort.Slice(enclosing, func(i, j int) bool {
+		return (enclosing[i].end - enclosing[i].start) < (enclosing[j].end - enclosing[j].start)
+	})
+	return enclosing
+}
+
+// resolveLocals assigns each definition to its nearest enclosing scope,
+// resolves each reference to the same-named definition in the nearest
+// enclosing scope that has one, and turns the result into highlightSpans.
+func resolveLocals(scopes []scopeRange, defs []*localDefinition, refs []localReference) []highlightSpan {
+	scopeDefs := make(map[scopeRange]map[string]*localDefinition)
+	for _, d := range defs {
+		owner := enclosingScopes(scopes, d.start, d.end)[0]
+		byName, ok := scopeDefs[owner]
+		if !ok {
+			byName = make(map[string]*localDefinition)
+			scopeDefs[owner] = byName
+		}
+		byName[d.name] = d
+	}
+
+	resolve := func(r localReference) *localDefinition {
+		for _, s := range enclosingScopes(scopes, r.start, r.end) {
+			if byName, ok := scopeDefs[s]; ok {
+				if d, ok := byName[r.name]; ok {
+					return d
+				}
+			}
+		}
+		return nil
+	}
+
+	var spans []highlightSpan
+
+	for _, r := range refs {
+		d := resolve(r)
+		if d == nil {
+			continue
+		}
+		d.used = true
+
+		capture := "local.variable"
+		switch d.kind {
+		case "function":
+			capture = "local.function.call"
+		case "parameter":
+			capture = "local.variable.parameter"
+		case "type":
+			capture = "local.type"
+		}
+		spans = append(spans, highlightSpan{start: r.start, end: r.end, capture: capture})
+	}
+
+	for _, d := range defs {
+		var capture string
+		switch d.kind {
+		case "function":
+			capture = "local.function.definition"
+		case "parameter":
+			if d.used {
+				capture = "local.variable.parameter"
+			} else {
+				capture = "local.variable.parameter.unused"
+			}
+		case "type":
+			capture = "local.type"
+		default: // "var" and anything the query didn't special-case
+			if d.used {
+				capture = "local.variable"
+			} else {
+				capture = "local.variable.unused"
+			}
+		}
+		spans = append(spans, highlightSpan{start: d.start, end: d.end, capture: capture})
+	}
+
+	return spans
+}
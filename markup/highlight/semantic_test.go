@@ -0,0 +1,105 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2024 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package highlight
+
+import (
+	"testing"
+
+	"github.com/frankban/quicktest"
+)
+
+func TestResolveLocals(t *testing.T) {
+	c := quicktest.New(t)
+
+	// Schematic offsets for func f(used, unused) { return used }: the
+	// parameters "used" at 4-8 and "unused" at 10-16, the body scope at
+	// 20-30, and the reference to "used" at 22-26 inside it.
+	scopes := []scopeRange{{start: 0, end: 40}, {start: 20, end: 30}}
+	defs := []*localDefinition{
+		{name: "used", kind: "parameter", start: 4, end: 8},
+		{name: "unused", kind: "parameter", start: 10, end: 16},
+	}
+	refs := []localReference{
+		{name: "used", start: 22, end: 26},
+	}
+
+	spans := resolveLocals(scopes, defs, refs)
+
+	byRange := make(map[[2]uint32]string)
+	for _, s := range spans {
+		byRange[[2]uint32{s.start, s.end}] = s.capture
+	}
+
+	c.Assert(byRange[[2]uint32{4, 8}], quicktest.Equals, "local.variable.parameter")
+	c.Assert(byRange[[2]uint32{10, 16}], quicktest.Equals, "local.variable.parameter.unused")
+	c.Assert(byRange[[2]uint32{22, 26}], quicktest.Equals, "local.variable.parameter")
+}
+
+func TestResolveLocalsFunctionDefinitionVsCall(t *testing.T) {
+	c := quicktest.New(t)
+
+	// func add() {}  ...  add()
+	scopes := []scopeRange{{start: 0, end: 50}}
+	defs := []*localDefinition{
+		{name: "add", kind: "function", start: 5, end: 8},
+	}
+	refs := []localReference{
+		{name: "add", start: 30, end: 33},
+	}
+
+	spans := resolveLocals(scopes, defs, refs)
+
+	byRange := make(map[[2]uint32]string)
+	for _, s := range spans {
+		byRange[[2]uint32{s.start, s.end}] = s.capture
+	}
+
+	c.Assert(byRange[[2]uint32{5, 8}], quicktest.Equals, "local.function.definition")
+	c.Assert(byRange[[2]uint32{30, 33}], quicktest.Equals, "local.function.call")
+}
+
+func TestEnclosingScopes(t *testing.T) {
+	c := quicktest.New(t)
+
+	scopes := []scopeRange{
+		{start: 0, end: 100},
+		{start: 10, end: 50},
+		{start: 20, end: 30},
+	}
+
+	enclosing := enclosingScopes(scopes, 22, 25)
+	c.Assert(enclosing, quicktest.HasLen, 3)
+	c.Assert(enclosing[0], quicktest.Equals, scopeRange{start: 20, end: 30})
+	c.Assert(enclosing[2], quicktest.Equals, scopeRange{start: 0, end: 100})
+}
+
+func TestTreeSitterSemanticHighlightingUnusedParameter(t *testing.T) {
+	c := quicktest.New(t)
+
+	cfg := DefaultConfig
+	cfg.NoClasses = false
+
+	h := NewWithTreeSitter(cfg)
+
+	code := "func add(a, b int) int {\n\treturn a + a\n}\n"
+	result, err := h.Highlight(code, "go", nil)
+	c.Assert(err, quicktest.IsNil)
+	// b is never referenced in the body and should be flagged as unused.
+	c.Assert(result, quicktest.Contains, "nv-unused")
+	// add is defined, not called, here.
+	c.Assert(result, quicktest.Contains, "nf")
+}
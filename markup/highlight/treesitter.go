@@ -18,13 +18,19 @@ package highlight
 
 import (
 	"context"
+	"embed"
 	"fmt"
 	"html"
 	"html/template"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/gohugoio/hugo/common/hugio"
 	"github.com/gohugoio/hugo/markup/converter/hooks"
+	"github.com/gohugoio/hugo/markup/internal/attributes"
 	sitter "github.com/smacker/go-tree-sitter"
 	"github.com/smacker/go-tree-sitter/bash"
 	"github.com/smacker/go-tree-sitter/c"
@@ -57,73 +63,302 @@ import (
 	"github.com/smacker/go-tree-sitter/yaml"
 )
 
-// treeSitterLanguages maps language names to their Tree-sitter grammar functions
-var treeSitterLanguages = map[string]func() *sitter.Language{
-	"bash":       bash.GetLanguage,
-	"sh":         bash.GetLanguage,
-	"shell":      bash.GetLanguage,
-	"c":          c.GetLanguage,
-	"cpp":        cpp.GetLanguage,
-	"c++":        cpp.GetLanguage,
-	"cxx":        cpp.GetLanguage,
-	"cc":         cpp.GetLanguage,
-	"csharp":     csharp.GetLanguage,
-	"c#":         csharp.GetLanguage,
-	"cs":         csharp.GetLanguage,
-	"css":        css.GetLanguage,
-	"cue":        cue.GetLanguage,
-	"dockerfile": dockerfile.GetLanguage,
-	"docker":     dockerfile.GetLanguage,
-	"elixir":     elixir.GetLanguage,
-	"ex":         elixir.GetLanguage,
-	"exs":        elixir.GetLanguage,
-	"elm":        elm.GetLanguage,
-	"go":         golang.GetLanguage,
-	"golang":     golang.GetLanguage,
-	"groovy":     groovy.GetLanguage,
-	"hcl":        hcl.GetLanguage,
-	"tf":         hcl.GetLanguage,
-	"html":       tshtml.GetLanguage,
-	"htm":        tshtml.GetLanguage,
-	"java":       java.GetLanguage,
-	"javascript": javascript.GetLanguage,
-	"js":         javascript.GetLanguage,
-	"jsx":        javascript.GetLanguage,
-	"kotlin":     kotlin.GetLanguage,
-	"kt":         kotlin.GetLanguage,
-	"lua":        lua.GetLanguage,
-	"ocaml":      ocaml.GetLanguage,
-	"ml":         ocaml.GetLanguage,
-	"php":        php.GetLanguage,
-	"protobuf":   protobuf.GetLanguage,
-	"proto":      protobuf.GetLanguage,
-	"python":     python.GetLanguage,
-	"py":         python.GetLanguage,
-	"ruby":       ruby.GetLanguage,
-	"rb":         ruby.GetLanguage,
-	"rust":       rust.GetLanguage,
-	"rs":         rust.GetLanguage,
-	"scala":      scala.GetLanguage,
-	"sql":        sql.GetLanguage,
-	"svelte":     svelte.GetLanguage,
-	"swift":      swift.GetLanguage,
-	"toml":       toml.GetLanguage,
-	"yaml":       yaml.GetLanguage,
-	"yml":        yaml.GetLanguage,
+// queriesFS embeds the per-language Tree-sitter query files (highlights.scm
+// and friends) shipped under queries/<lang>/. Every grammar has its own node
+// naming, so highlighting is driven off these queries rather than a single
+// global node-type-to-class table.
+//
+//go:embed queries
+var queriesFS embed.FS
+
+// treeSitterLanguage pairs a Tree-sitter grammar with the directory under
+// queries/ that holds its query files. Several language aliases (e.g. "js"
+// and "javascript") share a single grammar and therefore a single query
+// directory.
+type treeSitterLanguage struct {
+	grammar  func() *sitter.Language
+	queryDir string
+}
+
+// treeSitterLanguages maps language names (and common aliases) to their
+// Tree-sitter grammar and query directory.
+var treeSitterLanguages = map[string]treeSitterLanguage{
+	"bash":       {bash.GetLanguage, "bash"},
+	"sh":         {bash.GetLanguage, "bash"},
+	"shell":      {bash.GetLanguage, "bash"},
+	"c":          {c.GetLanguage, "c"},
+	"cpp":        {cpp.GetLanguage, "cpp"},
+	"c++":        {cpp.GetLanguage, "cpp"},
+	"cxx":        {cpp.GetLanguage, "cpp"},
+	"cc":         {cpp.GetLanguage, "cpp"},
+	"csharp":     {csharp.GetLanguage, "csharp"},
+	"c#":         {csharp.GetLanguage, "csharp"},
+	"cs":         {csharp.GetLanguage, "csharp"},
+	"css":        {css.GetLanguage, "css"},
+	"cue":        {cue.GetLanguage, "cue"},
+	"dockerfile": {dockerfile.GetLanguage, "dockerfile"},
+	"docker":     {dockerfile.GetLanguage, "dockerfile"},
+	"elixir":     {elixir.GetLanguage, "elixir"},
+	"ex":         {elixir.GetLanguage, "elixir"},
+	"exs":        {elixir.GetLanguage, "elixir"},
+	"elm":        {elm.GetLanguage, "elm"},
+	"go":         {golang.GetLanguage, "go"},
+	"golang":     {golang.GetLanguage, "go"},
+	"groovy":     {groovy.GetLanguage, "groovy"},
+	"hcl":        {hcl.GetLanguage, "hcl"},
+	"tf":         {hcl.GetLanguage, "hcl"},
+	"html":       {tshtml.GetLanguage, "html"},
+	"htm":        {tshtml.GetLanguage, "html"},
+	"java":       {java.GetLanguage, "java"},
+	"javascript": {javascript.GetLanguage, "javascript"},
+	"js":         {javascript.GetLanguage, "javascript"},
+	"jsx":        {javascript.GetLanguage, "javascript"},
+	"kotlin":     {kotlin.GetLanguage, "kotlin"},
+	"kt":         {kotlin.GetLanguage, "kotlin"},
+	"lua":        {lua.GetLanguage, "lua"},
+	"ocaml":      {ocaml.GetLanguage, "ocaml"},
+	"ml":         {ocaml.GetLanguage, "ocaml"},
+	"php":        {php.GetLanguage, "php"},
+	"protobuf":   {protobuf.GetLanguage, "protobuf"},
+	"proto":      {protobuf.GetLanguage, "protobuf"},
+	"python":     {python.GetLanguage, "python"},
+	"py":         {python.GetLanguage, "python"},
+	"ruby":       {ruby.GetLanguage, "ruby"},
+	"rb":         {ruby.GetLanguage, "ruby"},
+	"rust":       {rust.GetLanguage, "rust"},
+	"rs":         {rust.GetLanguage, "rust"},
+	"scala":      {scala.GetLanguage, "scala"},
+	"sql":        {sql.GetLanguage, "sql"},
+	"svelte":     {svelte.GetLanguage, "svelte"},
+	"swift":      {swift.GetLanguage, "swift"},
+	"toml":       {toml.GetLanguage, "toml"},
+	"yaml":       {yaml.GetLanguage, "yaml"},
+	"yml":        {yaml.GetLanguage, "yaml"},
+}
+
+// highlightQueryCache holds compiled *sitter.Query values keyed by query
+// directory, so a given language's highlights.scm is parsed only once.
+var highlightQueryCache sync.Map // map[string]*sitter.Query
+
+// loadHighlightQuery returns the compiled highlights.scm query for the given
+// query directory, compiling and caching it on first use.
+func loadHighlightQuery(queryDir string, lang *sitter.Language) (*sitter.Query, error) {
+	if cached, ok := highlightQueryCache.Load(queryDir); ok {
+		return cached.(*sitter.Query), nil
+	}
+
+	data, err := queriesFS.ReadFile(path.Join("queries", queryDir, "highlights.scm"))
+	if err != nil {
+		return nil, fmt.Errorf("highlight: no highlights.scm for %q: %w", queryDir, err)
+	}
+
+	query, err := sitter.NewQuery(data, lang)
+	if err != nil {
+		return nil, fmt.Errorf("highlight: compiling highlights.scm for %q: %w", queryDir, err)
+	}
+
+	actual, _ := highlightQueryCache.LoadOrStore(queryDir, query)
+	return actual.(*sitter.Query), nil
+}
+
+// compiledInjectionQuery pairs a compiled injections.scm with the fixed
+// language declared by each of its top-level patterns, for languages whose
+// injections always target one language (e.g. HTML's <script> always wants
+// "javascript") rather than naming it via an `@injection.language` capture.
+type compiledInjectionQuery struct {
+	query            *sitter.Query
+	patternLanguages []string
+}
+
+// injectionQueryCache holds compiledInjectionQuery values keyed by query
+// directory, mirroring highlightQueryCache.
+var injectionQueryCache sync.Map // map[string]*compiledInjectionQuery
+
+// setInjectionLanguageRE matches a `(#set! injection.language "lang")`
+// predicate, the convention grammars use to declare a fixed injected
+// language for a pattern that has no `@injection.language` capture of its
+// own (tree-sitter-html's <script>/<style> elements, for example).
+var setInjectionLanguageRE = regexp.MustCompile(`#set!\s+injection\.language\s+"([^"]+)"`)
+
+// patternInjectionLanguages scans an injections.scm file and returns, for
+// each top-level pattern in source order, the language named by a `#set!
+// injection.language` directive inside it (or "" if none). Tree-sitter
+// numbers a query's patterns by their order of appearance, so index i here
+// lines up with QueryMatch.PatternIndex == i.
+func patternInjectionLanguages(src []byte) []string {
+	var (
+		languages []string
+		depth     int
+		start     int
+	)
+	for i, b := range src {
+		switch b {
+		case '(':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				lang := ""
+				if m := setInjectionLanguageRE.FindSubmatch(src[start : i+1]); m != nil {
+					lang = string(m[1])
+				}
+				languages = append(languages, lang)
+			}
+		}
+	}
+	return languages
+}
+
+// loadInjectionQuery returns the compiled injections.scm query for the given
+// query directory, along with its per-pattern fixed languages, compiling and
+// caching on first use. It returns an error if the language has no
+// injections.scm, which simply means it has no embedded-language support
+// yet.
+func loadInjectionQuery(queryDir string, lang *sitter.Language) (*sitter.Query, []string, error) {
+	if cached, ok := injectionQueryCache.Load(queryDir); ok {
+		c := cached.(*compiledInjectionQuery)
+		return c.query, c.patternLanguages, nil
+	}
+
+	data, err := queriesFS.ReadFile(path.Join("queries", queryDir, "injections.scm"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query, err := sitter.NewQuery(data, lang)
+	if err != nil {
+		return nil, nil, fmt.Errorf("highlight: compiling injections.scm for %q: %w", queryDir, err)
+	}
+
+	compiled := &compiledInjectionQuery{query: query, patternLanguages: patternInjectionLanguages(data)}
+	actual, _ := injectionQueryCache.LoadOrStore(queryDir, compiled)
+	c := actual.(*compiledInjectionQuery)
+	return c.query, c.patternLanguages, nil
+}
+
+// highlightWriter is the minimal sink renderTreeSitterNode and its helpers
+// write HTML to; both strings.Builder and hugio.FlexiWriter satisfy it.
+type highlightWriter interface {
+	WriteString(string) (int, error)
+}
+
+// highlightSpan is a single Tree-sitter capture resolved to a byte range in
+// the source, ready to be turned into an HTML span.
+type highlightSpan struct {
+	start, end uint32
+	capture    string
+}
+
+// injectionRange is a byte range within a parent document that should be
+// highlighted with a different language's grammar, as resolved from an
+// injections.scm query (e.g. the body of an HTML <script> element).
+type injectionRange struct {
+	start, end uint32
+	lang       string
+}
+
+// captureClasses maps Tree-sitter capture names, as used by the bundled
+// highlights.scm queries, to Chroma-compatible CSS classes so Tree-sitter and
+// Chroma output can share the same stylesheets.
+var captureClasses = map[string]string{
+	"comment":               "c",
+	"comment.documentation": "cs",
+	"constant":              "no",
+	"constant.builtin":      "kc",
+	"string":                "s",
+	"string.escape":         "se",
+	"string.special":        "sx",
+	"string.regex":          "sr",
+	"number":                "m",
+	"boolean":               "kc",
+	"keyword":               "k",
+	"keyword.function":      "kd",
+	"keyword.operator":      "ow",
+	"keyword.return":        "k",
+	"keyword.import":        "kn",
+	"function":              "nf",
+	"function.builtin":      "nb",
+	"function.call":         "nf",
+	"function.macro":        "nf",
+	"method":                "nf",
+	"method.call":           "nf",
+	"parameter":             "nv",
+	"variable":              "n",
+	"variable.parameter":    "nv",
+	"variable.builtin":      "nb",
+	"variable.member":       "n",
+	"property":              "n",
+	"field":                 "n",
+	"type":                  "kt",
+	"type.builtin":          "kt",
+	"constructor":           "nf",
+	"tag":                   "nt",
+	"tag.attribute":         "na",
+	"attribute":             "na",
+	"punctuation.delimiter": "p",
+	"punctuation.bracket":   "p",
+	"punctuation.special":   "p",
+	"operator":              "o",
+	"label":                 "nl",
+	"namespace":             "nn",
+	"module":                "nn",
+	"include":               "kn",
+	"preproc":               "cp",
+	"error":                 "err",
+
+	// Synthetic captures emitted by collectSemanticSpans, not by any
+	// highlights.scm: these distinguish a binding's role (definition, call,
+	// unreferenced local) beyond what lexical highlighting alone can tell.
+	"local.function.definition":       "nf",
+	"local.function.call":             "nx",
+	"local.variable.parameter":        "nv-parameter",
+	"local.variable.parameter.unused": "nv-unused",
+	"local.variable":                  "nv",
+	"local.variable.unused":           "nv-unused",
+	"local.type":                      "kt",
+}
+
+// classForCapture maps a Tree-sitter capture name (e.g. "variable.parameter")
+// to a CSS class, falling back to progressively shorter dotted prefixes
+// (e.g. "variable.parameter.builtin" -> "variable.parameter" -> "variable")
+// when the exact capture isn't in captureClasses. It returns "" for captures
+// that shouldn't be rendered as a span at all.
+func classForCapture(capture string) string {
+	for capture != "" {
+		if class, ok := captureClasses[capture]; ok {
+			return class
+		}
+		idx := strings.LastIndex(capture, ".")
+		if idx < 0 {
+			break
+		}
+		capture = capture[:idx]
+	}
+	return ""
 }
 
 // treeSitterHighlighter uses Tree-sitter for syntax highlighting with fallback to Chroma
 type treeSitterHighlighter struct {
 	cfg            Config
 	chromaFallback Highlighter
+	cache          *htmlCache
 }
 
 // NewWithTreeSitter creates a new highlighter that uses Tree-sitter when available,
 // falling back to Chroma for unsupported languages
 func NewWithTreeSitter(cfg Config) Highlighter {
+	cacheSize := cfg.CacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultCacheSize
+	}
+
 	return &treeSitterHighlighter{
 		cfg:            cfg,
 		chromaFallback: chromaHighlighter{cfg: cfg},
+		cache:          newHTMLCache(cacheSize),
 	}
 }
 
@@ -168,13 +403,24 @@ func (h *treeSitterHighlighter) tryTreeSitter(code, lang string, opts any) (stri
 		return "", false
 	}
 
-	langFunc, supported := treeSitterLanguages[strings.ToLower(lang)]
+	if lang == "" && cfg.AutoDetect {
+		if guess := detectCodeLanguage(code, ""); guess.confidence >= cfg.AutoDetectMinConfidence {
+			lang = guess.lang
+		}
+	}
+
+	entry, supported := treeSitterLanguages[strings.ToLower(lang)]
 	if !supported {
 		return "", false
 	}
 
-	parser := sitter.NewParser()
-	parser.SetLanguage(langFunc())
+	key := cacheKey(entry.queryDir, code, cfg)
+	if cached, ok := h.cache.get(key); ok {
+		return cached, true
+	}
+
+	parser := acquireParser(entry)
+	defer releaseParser(entry, parser)
 
 	tree, err := parser.ParseCtx(context.Background(), nil, []byte(code))
 	if err != nil {
@@ -183,9 +429,12 @@ func (h *treeSitterHighlighter) tryTreeSitter(code, lang string, opts any) (stri
 	defer tree.Close()
 
 	var result strings.Builder
-	h.renderTreeSitterNode(tree.RootNode(), []byte(code), &result, cfg, lang)
+	h.renderTreeSitterNode(tree.RootNode(), []byte(code), &result, cfg, entry)
+
+	highlighted := result.String()
+	h.cache.add(key, highlighted)
 
-	return result.String(), true
+	return highlighted, true
 }
 
 // tryTreeSitterCodeBlock attempts to highlight a code block using Tree-sitter
@@ -204,24 +453,37 @@ func (h *treeSitterHighlighter) tryTreeSitterCodeBlock(ctx hooks.CodeblockContex
 		return HighlightResult{}, false
 	}
 
-	langFunc, supported := treeSitterLanguages[strings.ToLower(ctx.Type())]
+	lang, _ := resolveCodeBlockLanguage(cfg, ctx)
+	entry, supported := treeSitterLanguages[strings.ToLower(lang)]
 	if !supported {
 		return HighlightResult{}, false
 	}
 
-	parser := sitter.NewParser()
-	parser.SetLanguage(langFunc())
+	code := ctx.Inner()
+	key := cacheKey(entry.queryDir, code, cfg)
+	if cached, ok := h.cache.get(key); ok {
+		return HighlightResult{
+			highlighted: template.HTML(cached),
+			innerLow:    0,
+			innerHigh:   len(cached),
+		}, true
+	}
 
-	tree, err := parser.ParseCtx(context.Background(), nil, []byte(ctx.Inner()))
+	parser := acquireParser(entry)
+	defer releaseParser(entry, parser)
+
+	tree, err := parser.ParseCtx(context.Background(), nil, []byte(code))
 	if err != nil {
 		return HighlightResult{}, false
 	}
 	defer tree.Close()
 
 	var result strings.Builder
-	h.renderTreeSitterNode(tree.RootNode(), []byte(ctx.Inner()), &result, cfg, ctx.Type())
+	h.renderTreeSitterNode(tree.RootNode(), []byte(code), &result, cfg, entry)
 
 	highlighted := result.String()
+	h.cache.add(key, highlighted)
+
 	return HighlightResult{
 		highlighted: template.HTML(highlighted),
 		innerLow:    0,
@@ -241,13 +503,14 @@ func (h *treeSitterHighlighter) tryRenderTreeSitterCodeblock(cctx context.Contex
 		return false
 	}
 
-	langFunc, supported := treeSitterLanguages[strings.ToLower(ctx.Type())]
+	lang, detected := resolveCodeBlockLanguage(cfg, ctx)
+	entry, supported := treeSitterLanguages[strings.ToLower(lang)]
 	if !supported {
 		return false
 	}
 
-	parser := sitter.NewParser()
-	parser.SetLanguage(langFunc())
+	parser := acquireParser(entry)
+	defer releaseParser(entry, parser)
 
 	tree, err := parser.ParseCtx(cctx, nil, []byte(ctx.Inner()))
 	if err != nil {
@@ -255,19 +518,24 @@ func (h *treeSitterHighlighter) tryRenderTreeSitterCodeblock(cctx context.Contex
 	}
 	defer tree.Close()
 
-	attributes := ctx.(hooks.AttributesOptionsSliceProvider).AttributesSlice()
+	attributeSlice := ctx.(hooks.AttributesOptionsSliceProvider).AttributesSlice()
+	if detected {
+		// No language was set on the fence; expose the auto-detected one so
+		// themes can, for example, show a "detected" badge.
+		attributeSlice = append(attributeSlice, attributes.Attribute{Name: "data-detected-lang", Value: lang})
+	}
 
 	if !cfg.Hl_inline {
-		writeDivStart(w, attributes, cfg.WrapperClass)
+		writeDivStart(w, attributeSlice, cfg.WrapperClass)
 	}
 
 	if cfg.Hl_inline {
-		w.WriteString(fmt.Sprintf(`<code%s>`, inlineCodeAttrs(ctx.Type())))
+		w.WriteString(fmt.Sprintf(`<code%s>`, inlineCodeAttrs(lang)))
 	} else {
-		WritePreStart(w, ctx.Type(), "")
+		WritePreStart(w, lang, "")
 	}
 
-	h.renderTreeSitterNode(tree.RootNode(), []byte(ctx.Inner()), w, cfg, ctx.Type())
+	h.renderTreeSitterNode(tree.RootNode(), []byte(ctx.Inner()), w, cfg, entry)
 
 	if cfg.Hl_inline {
 		w.WriteString("</code>")
@@ -279,183 +547,281 @@ func (h *treeSitterHighlighter) tryRenderTreeSitterCodeblock(cctx context.Contex
 	return true
 }
 
-// renderTreeSitterNode renders a Tree-sitter node with syntax highlighting
-func (h *treeSitterHighlighter) renderTreeSitterNode(node *sitter.Node, source []byte, w interface{ WriteString(string) (int, error) }, cfg Config, lang string) {
-	if node == nil {
+// renderTreeSitterNode renders source highlighted by running entry's
+// highlights.scm query over root and emitting a <span> per resolved capture.
+// If the language has no query file yet, the source is emitted verbatim
+// (escaped) rather than guessed at from raw node types. Where entry also has
+// a locals.scm, the spans it resolves (a definition vs. a call, an unused
+// local, ...) are merged in, winning over the plain lexical capture for the
+// same range when the semantic capture name has more dotted parts. Any ranges matched by entry's injections.scm (e.g. a <script>
+// element's body) are carved out and recursively re-highlighted with their
+// own grammar instead.
+func (h *treeSitterHighlighter) renderTreeSitterNode(root *sitter.Node, source []byte, w highlightWriter, cfg Config, entry treeSitterLanguage) {
+	query, err := loadHighlightQuery(entry.queryDir, entry.grammar())
+	if err != nil {
+		w.WriteString(html.EscapeString(string(source)))
 		return
 	}
 
-	nodeType := node.Type()
+	spans := collectHighlightSpans(query, root, source)
+	if semantic := h.collectSemanticSpans(entry, root, source); len(semantic) > 0 {
+		spans = dedupeHighlightSpans(append(spans, semantic...))
+	}
+	injections := h.collectInjectionRanges(entry, root, source)
 
-	// Handle anonymous nodes (like punctuation) differently
-	if nodeType == "" {
-		// Anonymous node - just render content without styling
-		content := node.Content(source)
-		w.WriteString(html.EscapeString(content))
+	if len(injections) == 0 {
+		writeHighlightSpans(w, source, 0, uint32(len(source)), spans)
 		return
 	}
 
-	// If this is a leaf node, render it with appropriate styling
-	if node.ChildCount() == 0 {
-		content := node.Content(source)
-		class := h.mapNodeTypeToClass(nodeType)
+	spans = dropSpansInsideInjections(spans, injections)
+	h.writeWithInjections(w, source, spans, injections)
+}
+
+// collectInjectionRanges runs entry's injections.scm (if any) over root and
+// resolves each match to the byte range that should be re-highlighted and
+// the language to re-highlight it with. The language comes from an
+// `@injection.language` capture when present, otherwise from the pattern's
+// `#set! injection.language` directive. Matches naming an unsupported
+// language are skipped.
+func (h *treeSitterHighlighter) collectInjectionRanges(entry treeSitterLanguage, root *sitter.Node, source []byte) []injectionRange {
+	query, patternLanguages, err := loadInjectionQuery(entry.queryDir, entry.grammar())
+	if err != nil {
+		return nil
+	}
+
+	qc := sitter.NewQueryCursor()
+	defer qc.Close()
+	qc.Exec(query, root)
 
-		if class != "" {
-			w.WriteString(fmt.Sprintf(`<span class="%s">`, class))
-			w.WriteString(html.EscapeString(content))
-			w.WriteString("</span>")
-		} else {
-			w.WriteString(html.EscapeString(content))
+	var ranges []injectionRange
+	for {
+		match, ok := qc.NextMatch()
+		if !ok {
+			break
 		}
-		return
+
+		var contentNode *sitter.Node
+		lang := ""
+		for _, capture := range match.Captures {
+			switch query.CaptureNameForId(capture.Index) {
+			case "injection.content":
+				contentNode = capture.Node
+			case "injection.language":
+				lang = strings.ToLower(capture.Node.Content(source))
+			}
+		}
+
+		if lang == "" && int(match.PatternIndex) < len(patternLanguages) {
+			lang = patternLanguages[match.PatternIndex]
+		}
+
+		if contentNode == nil || lang == "" {
+			continue
+		}
+
+		if _, supported := treeSitterLanguages[lang]; !supported {
+			continue
+		}
+
+		ranges = append(ranges, injectionRange{
+			start: contentNode.StartByte(),
+			end:   contentNode.EndByte(),
+			lang:  lang,
+		})
 	}
 
-	// For non-leaf nodes, handle special cases
-	switch nodeType {
-	case "string_literal", "string", "interpreted_string_literal", "raw_string_literal":
-		// For string nodes, render the entire content as a string
-		content := node.Content(source)
-		w.WriteString(fmt.Sprintf(`<span class="s">%s</span>`, html.EscapeString(content)))
-		return
-	case "comment", "line_comment", "block_comment":
-		// For comment nodes, render the entire content as a comment
-		content := node.Content(source)
-		w.WriteString(fmt.Sprintf(`<span class="c">%s</span>`, html.EscapeString(content)))
+	return ranges
+}
+
+// dropSpansInsideInjections removes highlight spans that fall entirely
+// within an injection range, since that range will be re-highlighted (and
+// re-escaped) by its own grammar instead.
+func dropSpansInsideInjections(spans []highlightSpan, injections []injectionRange) []highlightSpan {
+	if len(injections) == 0 {
+		return spans
+	}
+
+	filtered := spans[:0]
+	for _, span := range spans {
+		inside := false
+		for _, inj := range injections {
+			if span.start >= inj.start && span.end <= inj.end {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			filtered = append(filtered, span)
+		}
+	}
+	return filtered
+}
+
+// writeWithInjections renders source in order, highlighting the gaps between
+// injection ranges with spans and splicing each injection's own recursively
+// highlighted output in at the right offset.
+func (h *treeSitterHighlighter) writeWithInjections(w highlightWriter, source []byte, spans []highlightSpan, injections []injectionRange) {
+	sort.Slice(injections, func(i, j int) bool { return injections[i].start < injections[j].start })
+
+	var pos uint32
+	for _, inj := range injections {
+		if inj.start > pos {
+			writeHighlightSpans(w, source, pos, inj.start, spans)
+		}
+		h.renderInjection(w, source, inj)
+		pos = inj.end
+	}
+	if pos < uint32(len(source)) {
+		writeHighlightSpans(w, source, pos, uint32(len(source)), spans)
+	}
+}
+
+// renderInjection parses an injection range's bytes with its own language
+// and feeds the result back through renderTreeSitterNode, so the injected
+// language's own injections.scm, where it has one, is applied to that range
+// too.
+func (h *treeSitterHighlighter) renderInjection(w highlightWriter, source []byte, inj injectionRange) {
+	entry, ok := treeSitterLanguages[inj.lang]
+	if !ok {
+		w.WriteString(html.EscapeString(string(source[inj.start:inj.end])))
 		return
 	}
 
-	// For other non-leaf nodes, check if we should style the whole node
-	class := h.mapNodeTypeToClass(nodeType)
-	if class != "" {
-		w.WriteString(fmt.Sprintf(`<span class="%s">`, class))
+	sub := source[inj.start:inj.end]
+
+	parser := acquireParser(entry)
+	defer releaseParser(entry, parser)
+
+	tree, err := parser.ParseCtx(context.Background(), nil, sub)
+	if err != nil {
+		w.WriteString(html.EscapeString(string(sub)))
+		return
 	}
+	defer tree.Close()
+
+	h.renderTreeSitterNode(tree.RootNode(), sub, w, h.cfg, entry)
+}
 
-	// Recursively render children
-	for i := uint32(0); i < node.ChildCount(); i++ {
-		child := node.Child(int(i))
-		if child != nil {
-			h.renderTreeSitterNode(child, source, w, cfg, lang)
+// collectHighlightSpans runs query over root and returns one highlightSpan
+// per capture, with duplicate captures over the same byte range resolved to
+// the single most specific one.
+func collectHighlightSpans(query *sitter.Query, root *sitter.Node, source []byte) []highlightSpan {
+	qc := sitter.NewQueryCursor()
+	defer qc.Close()
+	qc.Exec(query, root)
+
+	var spans []highlightSpan
+	for {
+		match, ok := qc.NextMatch()
+		if !ok {
+			break
+		}
+		for _, capture := range match.Captures {
+			spans = append(spans, highlightSpan{
+				start:   capture.Node.StartByte(),
+				end:     capture.Node.EndByte(),
+				capture: query.CaptureNameForId(capture.Index),
+			})
 		}
 	}
 
-	// Close the span if we opened one
-	if class != "" {
-		w.WriteString("</span>")
+	return dedupeHighlightSpans(spans)
+}
+
+// dedupeHighlightSpans collapses multiple captures over the exact same byte
+// range down to one, keeping the capture name with the most dotted
+// qualifiers (e.g. "variable.parameter" beats "variable").
+func dedupeHighlightSpans(spans []highlightSpan) []highlightSpan {
+	if len(spans) == 0 {
+		return spans
 	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].end > spans[j].end
+	})
+
+	deduped := spans[:0]
+	for i, span := range spans {
+		if i > 0 {
+			last := len(deduped) - 1
+			if deduped[last].start == span.start && deduped[last].end == span.end {
+				if captureSpecificity(span.capture) > captureSpecificity(deduped[last].capture) {
+					deduped[last] = span
+				}
+				continue
+			}
+		}
+		deduped = append(deduped, span)
+	}
+	return deduped
+}
+
+func captureSpecificity(capture string) int {
+	return strings.Count(capture, ".") + 1
+}
+
+// highlightEvent is a span boundary (open or close) used to flatten the
+// possibly-nested highlightSpan set into well-formed, non-overlapping HTML.
+type highlightEvent struct {
+	pos   uint32
+	start bool
+	span  highlightSpan
 }
 
-// mapNodeTypeToClass maps Tree-sitter node types to CSS classes
-func (h *treeSitterHighlighter) mapNodeTypeToClass(nodeType string) string {
-	// Map common Tree-sitter node types to Chroma-compatible CSS classes
-	classMap := map[string]string{
-		// Comments
-		"comment":       "c",
-		"line_comment":  "c1",
-		"block_comment": "cm",
-
-		// Strings
-		"string":          "s",
-		"string_literal":  "s",
-		"raw_string":      "s",
-		"template_string": "s",
-		"char_literal":    "s1",
-
-		// Numbers
-		"number":  "m",
-		"integer": "mi",
-		"float":   "mf",
-		"decimal": "m",
-
-		// Keywords
-		"keyword":   "k",
-		"if":        "k",
-		"else":      "k",
-		"for":       "k",
-		"while":     "k",
-		"function":  "nf",
-		"return":    "k",
-		"import":    "kn",
-		"from":      "kn",
-		"class":     "k",
-		"def":       "k",
-		"var":       "k",
-		"let":       "k",
-		"const":     "k",
-		"true":      "kc",
-		"false":     "kc",
-		"null":      "kc",
-		"undefined": "kc",
-
-		// Identifiers
-		"identifier":           "n",
-		"variable":             "n",
-		"property":             "n",
-		"field":                "n",
-		"method":               "nf",
-		"function_name":        "nf",
-		"function_declaration": "nf",
-		"function_definition":  "nf",
-
-		// Types
-		"type":            "kt",
-		"type_identifier": "kt",
-		"primitive_type":  "kt",
-
-		// Operators
-		"operator":        "o",
-		"assignment":      "o",
-		"binary_operator": "o",
-		"unary_operator":  "o",
-
-		// Punctuation
-		"punctuation": "p",
-		";":           "p",
-		",":           "p",
-		".":           "p",
-		":":           "p",
-		"(":           "p",
-		")":           "p",
-		"{":           "p",
-		"}":           "p",
-		"[":           "p",
-		"]":           "p",
-
-		// Attributes/Annotations
-		"attribute":  "nd",
-		"annotation": "nd",
-		"decorator":  "nd",
-
-		// Preprocessor
-		"preproc":      "cp",
-		"preprocessor": "cp",
-
-		// Errors
-		"ERROR": "err",
-	}
-
-	if class, exists := classMap[nodeType]; exists {
-		return class
-	}
-
-	// Handle some common patterns
-	if strings.Contains(nodeType, "comment") {
-		return "c"
-	}
-	if strings.Contains(nodeType, "string") {
-		return "s"
-	}
-	if strings.Contains(nodeType, "number") || strings.Contains(nodeType, "literal") {
-		return "m"
-	}
-	if strings.Contains(nodeType, "keyword") {
-		return "k"
-	}
-	if strings.Contains(nodeType, "type") {
-		return "kt"
-	}
-	if strings.Contains(nodeType, "function") && !strings.Contains(nodeType, "call") {
-		return "nf"
+// writeHighlightSpans walks source[from:to] top-to-bottom, writing escaped
+// text interleaved with <span> tags for each highlightSpan that falls within
+// that range. Spans are expected to either nest or be disjoint, as they
+// originate from a Tree-sitter parse tree, so a simple stack-ordered event
+// sort keeps the output well-formed. The range is taken out of the full
+// source, rather than a pre-sliced one, so spans (which hold absolute byte
+// offsets) don't need adjusting when rendering a gap between injections.
+func writeHighlightSpans(w highlightWriter, source []byte, from, to uint32, spans []highlightSpan) {
+	events := make([]highlightEvent, 0, len(spans)*2)
+	for _, span := range spans {
+		if span.start < from || span.end > to {
+			continue
+		}
+		if classForCapture(span.capture) == "" {
+			continue
+		}
+		events = append(events, highlightEvent{pos: span.start, start: true, span: span})
+		events = append(events, highlightEvent{pos: span.end, start: false, span: span})
 	}
 
-	return ""
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].pos != events[j].pos {
+			return events[i].pos < events[j].pos
+		}
+		// Close spans before opening new ones at the same offset.
+		if events[i].start != events[j].start {
+			return !events[i].start
+		}
+		length := func(e highlightEvent) uint32 { return e.span.end - e.span.start }
+		if events[i].start {
+			// Wider spans open first so narrower ones nest inside them.
+			return length(events[i]) > length(events[j])
+		}
+		// Narrower (more recently opened) spans close first.
+		return length(events[i]) < length(events[j])
+	})
+
+	pos := from
+	for _, ev := range events {
+		if ev.pos > pos {
+			w.WriteString(html.EscapeString(string(source[pos:ev.pos])))
+			pos = ev.pos
+		}
+		if ev.start {
+			w.WriteString(fmt.Sprintf(`<span class="%s">`, classForCapture(ev.span.capture)))
+		} else {
+			w.WriteString("</span>")
+		}
+	}
+	if pos < to {
+		w.WriteString(html.EscapeString(string(source[pos:to])))
+	}
 }
@@ -18,6 +18,7 @@ package highlight
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -252,29 +253,79 @@ func TestTreeSitterSupportedLanguages(t *testing.T) {
 	}
 }
 
-func TestTreeSitterClassMapping(t *testing.T) {
+func TestPatternInjectionLanguages(t *testing.T) {
+	c := quicktest.New(t)
+
+	src := []byte(`
+(script_element
+  (raw_text) @injection.content
+  (#set! injection.language "javascript"))
+
+(style_element
+  (raw_text) @injection.content
+  (#set! injection.language "css"))
+`)
+
+	languages := patternInjectionLanguages(src)
+	c.Assert(languages, quicktest.DeepEquals, []string{"javascript", "css"})
+}
+
+func TestDropSpansInsideInjections(t *testing.T) {
 	c := quicktest.New(t)
 
-	h := &treeSitterHighlighter{}
+	spans := []highlightSpan{
+		{start: 0, end: 5, capture: "tag"},
+		{start: 10, end: 20, capture: "variable"}, // fully inside the injection below
+		{start: 30, end: 35, capture: "tag"},
+	}
+	injections := []injectionRange{{start: 8, end: 22, lang: "javascript"}}
+
+	filtered := dropSpansInsideInjections(spans, injections)
+	c.Assert(filtered, quicktest.HasLen, 2)
+	c.Assert(filtered[0].start, quicktest.Equals, uint32(0))
+	c.Assert(filtered[1].start, quicktest.Equals, uint32(30))
+}
+
+func TestTreeSitterHTMLScriptInjection(t *testing.T) {
+	c := quicktest.New(t)
+
+	cfg := DefaultConfig
+	cfg.NoClasses = false
+
+	h := NewWithTreeSitter(cfg)
+
+	code := `<html><body><script>const x = 1;</script></body></html>`
+	result, err := h.Highlight(code, "html", nil)
+	c.Assert(err, quicktest.IsNil)
+	// The script body should come back highlighted as JavaScript, not as
+	// unstyled HTML text content.
+	c.Assert(result, quicktest.Contains, `<span class="k">const</span>`)
+}
+
+func TestClassForCapture(t *testing.T) {
+	c := quicktest.New(t)
 
 	testCases := []struct {
-		nodeType      string
+		capture       string
 		expectedClass string
 	}{
 		{"comment", "c"},
 		{"string", "s"},
 		{"number", "m"},
 		{"keyword", "k"},
-		{"identifier", "n"},
-		{"function_name", "nf"},
-		{"method", "nf"},
+		{"variable", "n"},
+		{"variable.parameter", "nv"},
+		// Unknown dotted suffixes fall back to the nearest known prefix.
+		{"variable.parameter.builtin", "nv"},
+		{"function.call", "nf"},
 		{"type", "kt"},
-		{"ERROR", "err"},
+		{"error", "err"},
+		{"not.a.real.capture", ""},
 	}
 
 	for _, tc := range testCases {
-		c.Run(tc.nodeType, func(c *quicktest.C) {
-			class := h.mapNodeTypeToClass(tc.nodeType)
+		c.Run(tc.capture, func(c *quicktest.C) {
+			class := classForCapture(tc.capture)
 			c.Assert(class, quicktest.Equals, tc.expectedClass)
 		})
 	}
@@ -425,3 +476,42 @@ console.log("Fibonacci(10) =", result);`
 		}
 	})
 }
+
+// BenchmarkTreeSitterCaching compares repeatedly highlighting the same code
+// (warm: every call hits the htmlCache) against highlighting a fresh
+// variation of it every time (cold: every call parses and runs the queries
+// again), quantifying what Config.CacheSize buys a site with many repeated
+// code blocks.
+func BenchmarkTreeSitterCaching(b *testing.B) {
+	cfg := DefaultConfig
+	code := `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}`
+
+	b.Run("Warm", func(b *testing.B) {
+		h := NewWithTreeSitter(cfg)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := h.Highlight(code, "go", nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Cold", func(b *testing.B) {
+		h := NewWithTreeSitter(cfg)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// Appending a per-iteration comment defeats the cache while
+			// keeping the parse/query workload equivalent to the warm case.
+			variant := fmt.Sprintf("%s\n// %d", code, i)
+			if _, err := h.Highlight(variant, "go", nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}